@@ -0,0 +1,65 @@
+package clouddetect
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+)
+
+// ProviderAlibaba is Alibaba Cloud
+const ProviderAlibaba = "Alibaba Cloud"
+
+// AlibabaProvider fetches Alibaba Cloud's published IP ranges. It's not
+// registered by default; opt in with RegisterProvider or WithProviders:
+//
+//	client.RegisterProvider(clouddetect.AlibabaProvider{})
+type AlibabaProvider struct{}
+
+func (AlibabaProvider) Name() string { return ProviderAlibaba }
+
+func (AlibabaProvider) Fetch(ctx context.Context) ([]*Response, error) {
+	return getAlibabaCIDRs(ctx)
+}
+
+type alibabaIPRanges struct {
+	Prefixes []struct {
+		IPPrefix string `json:"ip_prefix"`
+		Region   string `json:"region"`
+	} `json:"prefixes"`
+}
+
+func getAlibabaCIDRs(ctx context.Context) ([]*Response, error) {
+	ipRanges := alibabaIPRanges{}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", "https://ip-ranges.alibabacloud.com/ip-ranges.json", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Body.Close()
+
+	if err = json.NewDecoder(r.Body).Decode(&ipRanges); err != nil {
+		return nil, err
+	}
+
+	responses := []*Response{}
+	for _, prefix := range ipRanges.Prefixes {
+		_, ipNet, err := net.ParseCIDR(prefix.IPPrefix)
+		if err != nil {
+			return nil, err
+		}
+		resp := &Response{
+			ProviderName: ProviderAlibaba,
+			Region:       prefix.Region,
+			Subnet:       ipNet,
+		}
+		responses = append(responses, resp)
+	}
+
+	return responses, nil
+}
@@ -1,11 +1,42 @@
 package clouddetect
 
 import (
+	"context"
 	"encoding/json"
 	"net"
 	"net/http"
 )
 
+// amazonProvider tracks bytesDownloaded from its last fetch so it can
+// implement ByteCounter; refreshCacheFromWeb fetches each provider from its
+// own goroutine and waits for all of them before reading this back, so
+// there's no concurrent access to worry about.
+type amazonProvider struct {
+	bytesDownloaded int64
+}
+
+func (*amazonProvider) Name() string { return ProviderAmazon }
+
+func (p *amazonProvider) Fetch(ctx context.Context) ([]*Response, error) {
+	ranges, _, _, err := p.FetchConditional(ctx, ProviderValidator{})
+	return ranges, err
+}
+
+// FetchConditional implements ConditionalProvider using the ip-ranges.json
+// response's ETag and Last-Modified headers, so an unchanged feed costs a
+// 304 instead of a full re-download and re-parse.
+func (p *amazonProvider) FetchConditional(ctx context.Context, prev ProviderValidator) ([]*Response, ProviderValidator, bool, error) {
+	ranges, validator, notModified, n, err := getAmazonCIDRsConditional(ctx, prev)
+	p.bytesDownloaded = n
+	return ranges, validator, notModified, err
+}
+
+var _ ConditionalProvider = (*amazonProvider)(nil)
+var _ ByteCounter = (*amazonProvider)(nil)
+
+// BytesDownloaded implements ByteCounter.
+func (p *amazonProvider) BytesDownloaded() int64 { return p.bytesDownloaded }
+
 type amazonIPPrefixes struct {
 	SyncToken  string `json:"syncToken"`
 	CreateDate string `json:"createDate"`
@@ -21,29 +52,52 @@ type amazonIPPrefixes struct {
 	} `json:"ipv6_prefixes"`
 }
 
-func getAmazonCIDRs() ([]*Response, error) {
-	ipPrefixes := amazonIPPrefixes{}
+func getAmazonCIDRs(ctx context.Context) ([]*Response, error) {
+	responses, _, _, _, err := getAmazonCIDRsConditional(ctx, ProviderValidator{})
+	return responses, err
+}
 
-	r, err := http.Get("https://ip-ranges.amazonaws.com/ip-ranges.json")
+func getAmazonCIDRsConditional(ctx context.Context, prev ProviderValidator) ([]*Response, ProviderValidator, bool, int64, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", "https://ip-ranges.amazonaws.com/ip-ranges.json", nil)
 	if err != nil {
-		return nil, err
+		return nil, ProviderValidator{}, false, 0, err
+	}
+	if prev.ETag != "" {
+		req.Header.Set("If-None-Match", prev.ETag)
+	}
+	if prev.LastModified != "" {
+		req.Header.Set("If-Modified-Since", prev.LastModified)
+	}
+
+	r, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, ProviderValidator{}, false, 0, err
 	}
 	defer r.Body.Close()
+	body := &countingReader{r: r.Body}
+
+	validator := ProviderValidator{ETag: r.Header.Get("ETag"), LastModified: r.Header.Get("Last-Modified")}
+	if r.StatusCode == http.StatusNotModified {
+		return nil, validator, true, 0, nil
+	}
 
-	if err = json.NewDecoder(r.Body).Decode(&ipPrefixes); err != nil {
-		return nil, err
+	ipPrefixes := amazonIPPrefixes{}
+	if err = json.NewDecoder(body).Decode(&ipPrefixes); err != nil {
+		return nil, ProviderValidator{}, false, body.n, err
 	}
+	validator.SyncToken = ipPrefixes.SyncToken
 
 	responses := []*Response{}
 
 	for _, prefix := range ipPrefixes.Prefixes {
 		_, ipNet, err := net.ParseCIDR(prefix.IPPrefix)
 		if err != nil {
-			return nil, err
+			return nil, ProviderValidator{}, false, body.n, err
 		}
 		resp := &Response{
 			ProviderName: ProviderAmazon,
 			Region:       prefix.Region,
+			Service:      prefix.Service,
 			Subnet:       ipNet,
 		}
 		responses = append(responses, resp)
@@ -53,15 +107,16 @@ func getAmazonCIDRs() ([]*Response, error) {
 	for _, prefix := range ipPrefixes.Ipv6Prefixes {
 		_, ipNet, err := net.ParseCIDR(prefix.Ipv6Prefix)
 		if err != nil {
-			return nil, err
+			return nil, ProviderValidator{}, false, body.n, err
 		}
 		resp := &Response{
 			ProviderName: ProviderAmazon,
 			Region:       prefix.Region,
+			Service:      prefix.Service,
 			Subnet:       ipNet,
 		}
 		responses = append(responses, resp)
 	}
 
-	return responses, nil
+	return responses, validator, false, body.n, nil
 }
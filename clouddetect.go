@@ -1,53 +1,139 @@
 package clouddetect
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
+	"log/slog"
 	"net"
 	"os"
+	"strings"
 	"sync"
 	"time"
+
+	"github.com/gofrs/flock"
+	"golang.org/x/sync/singleflight"
 )
 
 var (
 	DefaultCacheRefreshTimeout time.Duration = 2 * time.Minute
-	logger                     *Logger       = &Logger{false}
+	// logger is kept only so code written against the old boolean-gated
+	// Logger keeps compiling; it's no longer consulted for output. Use
+	// Client.Logger (a *slog.Logger) instead.
+	logger *Logger = &Logger{false}
+
+	// disabledLogger is used when Client.Logger is unset, matching the
+	// previous default of no output.
+	disabledLogger = slog.New(slog.NewTextHandler(io.Discard, nil))
 )
 
 // Client will eventually hold cache of IP ranges
 type Client struct {
 	// unexported cache storage
-	subnetCache            []*Response
-	cacheWriteTime         time.Time
-	cacheMutex             *sync.RWMutex
-	cacheSource            string
-	cacheRefreshInProgress bool
+	subnetCache    []*Response
+	subnetTrie     *subnetTrie
+	cacheWriteTime time.Time
+	cacheMutex     *sync.RWMutex
+	cacheSource    string
+
+	// providerValidators holds the ETag/Last-Modified/syncToken each
+	// ConditionalProvider returned on its last fetch, keyed by provider
+	// name, so the next refresh can send conditional request headers.
+	providerValidators map[string]ProviderValidator
+
+	// refreshGroup coalesces concurrent cache refreshes: all callers that
+	// arrive while one is in flight block on the same result instead of
+	// racing or erroring. It's keyed by a single constant rather than per
+	// provider: a refresh always fetches every Provider together (they're
+	// already parallelized within refreshCacheFromWeb) to build one atomic
+	// subnetCache/subnetTrie snapshot, so there's no such thing as two
+	// refreshes in flight for different providers to coalesce separately -
+	// only ever one refresh, or none, per Client.
+	refreshGroup singleflight.Group
+
+	// shutdownCtx/shutdownCancel bound the background refresh goroutine
+	// started by ResolveContext, so Close can stop it deterministically.
+	shutdownCtx    context.Context
+	shutdownCancel context.CancelFunc
 
 	// Time to keep IP ranges cached for (default 12 hours)
 	TTL                 time.Duration
 	CacheFilePath       string
 	CacheRefreshTimeout time.Duration
+
+	// MaxStaleAge, if non-zero, lets Resolve serve a disk cache that has
+	// passed TTL (but is younger than MaxStaleAge) immediately on the first
+	// call, kicking off a background refresh rather than blocking the
+	// caller on a synchronous download. Zero disables stale serving, and
+	// the first call behaves as before: it blocks until a fresh cache is
+	// loaded.
+	MaxStaleAge time.Duration
+
+	// DNSResolver performs the TXT lookups used by providers such as Google
+	// that publish their ranges via SPF records. It defaults to the host's
+	// system resolver, but can be set to a DoHResolver or DoTResolver to
+	// avoid depending on local DNS infrastructure.
+	DNSResolver Resolver
+
+	// Providers is the set of providers consulted on each cache refresh. It
+	// defaults to Amazon, Google, and Microsoft; use RegisterProvider or
+	// WithProviders to opt in to the likes of OracleProvider,
+	// DigitalOceanProvider, IBMProvider, AlibabaProvider, and
+	// CloudflareProvider, register a third party's Provider, or reslice to
+	// remove ones you don't want.
+	Providers []Provider
+
+	// Metrics, if set, receives counters/histograms for cache hits, misses,
+	// refresh durations, and per-provider subnet counts. See MetricsCollector.
+	Metrics MetricsCollector
+
+	// Logger, if set, receives structured diagnostic output from cache
+	// refreshes (what's being downloaded, lock file handling, disk I/O
+	// errors, etc.) so it can be wired into a host application's logging
+	// stack with levels and request-scoped attributes. Nil (the default)
+	// discards all output.
+	Logger *slog.Logger
+
+	// OnRefreshStart, if set, is called at the start of every cache refresh.
+	OnRefreshStart func()
+	// OnRefreshComplete, if set, is called at the end of every cache
+	// refresh with the error it completed with, if any.
+	OnRefreshComplete func(err error)
+	// OnResolveMiss, if set, is called whenever Resolve/ResolveContext fails
+	// to match an IP against any cached subnet.
+	OnResolveMiss func(ip net.IP)
+
+	// IgnoreServices lists Response.Service values to skip when resolving,
+	// e.g. []string{"S3", "CLOUDFRONT"} to only match compute ranges.
+	IgnoreServices []string
 }
 
 type diskCache struct {
 	SubnetCache []*Response `json:"cache"`
+	// ProviderValidators lets a future refresh send conditional request
+	// headers instead of always re-fetching full provider payloads.
+	ProviderValidators map[string]ProviderValidator `json:"providerValidators,omitempty"`
 }
 
 // Response provides details of the cloud environment the IP resolved to
 type Response struct {
-	ProviderName string     `json:"providerName"`
-	Region       string     `json:"region"`
-	Subnet       *net.IPNet `json:"subnet"`
+	ProviderName string `json:"providerName"`
+	Region       string `json:"region"`
+	// Service is the provider-specific service or tag the range was
+	// published under, e.g. AWS's "EC2"/"S3"/"CLOUDFRONT" or the
+	// systemService of an Azure service tag. It's empty for providers (and
+	// Azure tags) that don't publish this.
+	Service string     `json:"service,omitempty"`
+	Subnet  *net.IPNet `json:"subnet"`
 }
 
 var (
 	// ErrNotCloudIP is error returned when IP does not match any of the published list of ranges
 	ErrNotCloudIP = errors.New("not resolved to any known cloud IP range")
-	// ErrCacheRefreshInProgress is returned when RefreshCache is called while an existing refresh is occurring
-	ErrCacheRefreshInProgress = errors.New("cache refresh is already in progress")
 	// ErrDiskCacheExpired is returned when trying to refresh from disk with a file that has exceeded the TTL
 	ErrDiskCacheExpired = errors.New("cache on disk is expired")
 )
@@ -65,11 +151,23 @@ const (
 
 // NewClient generates a Client with specified cache TTL
 func NewClient(TTL time.Duration) *Client {
-	return &Client{
+	c := &Client{
 		TTL:                 TTL,
 		cacheMutex:          &sync.RWMutex{},
 		CacheRefreshTimeout: DefaultCacheRefreshTimeout,
+		DNSResolver:         systemResolver{},
+		providerValidators:  map[string]ProviderValidator{},
 	}
+	c.shutdownCtx, c.shutdownCancel = context.WithCancel(context.Background())
+	c.Providers = defaultProviders(c)
+	return c
+}
+
+// Close stops the background cache refresh goroutine that ResolveContext may
+// have started. It's safe to call multiple times; the Client must not be
+// used afterwards.
+func (c *Client) Close() {
+	c.shutdownCancel()
 }
 
 var defaultClient *Client
@@ -90,266 +188,456 @@ func Resolve(ip net.IP) (*Response, error) {
 // Resolve will take the given ip and determine if it exists within any of the major
 // cloud providers' published IP ranges and any extra metadata that may be of use.
 // It returns ErrNotCloudIP if the IP does not resolve against any lists
-func (c *Client) Resolve(ip net.IP) (response *Response, err error) {
-	self := "clouddetect.Resolve"
+func (c *Client) Resolve(ip net.IP) (*Response, error) {
+	return c.ResolveContext(context.Background(), ip)
+}
+
+// ResolveContext is like Resolve but accepts a context.Context that can
+// cancel or bound a synchronous cache refresh triggered by the call.
+func (c *Client) ResolveContext(ctx context.Context, ip net.IP) (response *Response, err error) {
+	c.ensureCacheFresh(ctx)
+
+	c.cacheMutex.RLock()
+	// Copy the pointer so we don't hold the read-lock too long and prevent async RefreshCache from completing
+	trie := c.subnetTrie
+	c.cacheMutex.RUnlock()
+
+	if trie != nil {
+		matches := trie.lookupAll(ip)
+		// Walk from most to least specific so overlapping, differently-tagged
+		// prefixes (e.g. an ignored "S3" range nested inside "AMAZON") don't
+		// hide a perfectly good match at a shorter prefix.
+		for i := len(matches) - 1; i >= 0; i-- {
+			if c.isIgnoredService(matches[i].Service) {
+				continue
+			}
+			if c.Metrics != nil {
+				c.Metrics.ObserveResolve(matches[i].ProviderName, true)
+			}
+			return matches[i], nil
+		}
+	}
+
+	if c.Metrics != nil {
+		c.Metrics.ObserveResolve("", false)
+	}
+	if c.OnResolveMiss != nil {
+		c.OnResolveMiss(ip)
+	}
+
+	return nil, ErrNotCloudIP
+}
+
+// ResolveDetailed is a convenience function to resolve an IP against the
+// DefaultClient, returning every matching prefix.
+func ResolveDetailed(ip net.IP) ([]*Response, error) {
+	return DefaultClient().ResolveDetailed(ip)
+}
+
+// ResolveDetailed is like Resolve, but returns every published prefix that
+// matches ip instead of just the most specific one. This is useful since an
+// IP can legitimately belong to several overlapping tags at once, e.g. AWS's
+// EC2, AMAZON, and CLOUDFRONT ranges frequently nest.
+func (c *Client) ResolveDetailed(ip net.IP) ([]*Response, error) {
+	return c.ResolveDetailedContext(context.Background(), ip)
+}
+
+// ResolveDetailedContext is like ResolveDetailed but accepts a
+// context.Context that can cancel or bound a synchronous cache refresh
+// triggered by the call.
+func (c *Client) ResolveDetailedContext(ctx context.Context, ip net.IP) ([]*Response, error) {
+	c.ensureCacheFresh(ctx)
+
+	c.cacheMutex.RLock()
+	trie := c.subnetTrie
+	c.cacheMutex.RUnlock()
+
+	matches := []*Response{}
+	if trie != nil {
+		for _, match := range trie.lookupAll(ip) {
+			if !c.isIgnoredService(match.Service) {
+				matches = append(matches, match)
+			}
+		}
+	}
+
+	if len(matches) == 0 {
+		if c.Metrics != nil {
+			c.Metrics.ObserveResolve("", false)
+		}
+		if c.OnResolveMiss != nil {
+			c.OnResolveMiss(ip)
+		}
+		return nil, ErrNotCloudIP
+	}
+
+	if c.Metrics != nil {
+		c.Metrics.ObserveResolve(matches[len(matches)-1].ProviderName, true)
+	}
+
+	return matches, nil
+}
+
+// isIgnoredService reports whether service is listed in c.IgnoreServices.
+func (c *Client) isIgnoredService(service string) bool {
+	for _, ignored := range c.IgnoreServices {
+		if ignored == service {
+			return true
+		}
+	}
+	return false
+}
+
+// ensureCacheFresh triggers a cache refresh if the cache is empty or past
+// its TTL, synchronously on first use and asynchronously thereafter.
+func (c *Client) ensureCacheFresh(ctx context.Context) {
+	self := "clouddetect.ensureCacheFresh"
 
 	c.cacheMutex.RLock()
 	if len(c.subnetCache) == 0 || c.cacheWriteTime.Add(c.TTL).Before(time.Now()) {
 		c.cacheMutex.RUnlock()
-		logger.Printf("[%s] Cloud IP cache may need to be refreshed", self)
+		c.log("[%s] Cloud IP cache may need to be refreshed", self)
 
 		// Only allow one thread to actually trigger a cache refresh update
 		c.cacheMutex.Lock()
 		if c.cacheWriteTime.Add(c.TTL).Before(time.Now()) {
 			isFirstRun := len(c.subnetCache) == 0
-			logger.Printf("[%s] Cloud IP cache needs to be refreshed, isFirstRun = %t", self, isFirstRun)
+			c.log("[%s] Cloud IP cache needs to be refreshed, isFirstRun = %t", self, isFirstRun)
+
+			if isFirstRun && c.MaxStaleAge > 0 && c.CacheFilePath != "" {
+				if stat, statErr := os.Stat(c.CacheFilePath); statErr == nil && time.Since(stat.ModTime()) <= c.MaxStaleAge {
+					// The disk cache is past TTL but still within MaxStaleAge:
+					// load it synchronously (cheap, local I/O only) and serve
+					// it immediately rather than blocking this first caller on
+					// a synchronous web download, then refresh in the background.
+					c.log("[%s] Serving stale disk cache while refreshing in the background", self)
+					if loadErr := c.refreshCacheFromDisk(true, time.Time{}); loadErr == nil {
+						c.cacheMutex.Unlock()
+						go c.refreshCache(c.shutdownCtx, false, time.Time{})
+						return
+					} else {
+						c.log("[%s] Could not load stale disk cache, falling back to synchronous refresh: %v", self, loadErr)
+					}
+				}
+			}
 
 			if isFirstRun {
 				// Synchronously refresh the cache because we don't yet have any subnets
-				c.refreshCache(true, c.cacheWriteTime)
+				c.refreshCache(ctx, true, c.cacheWriteTime)
 				c.cacheMutex.Unlock()
-				logger.Printf("[%s] Synchronously refreshed cache", self)
+				c.log("[%s] Synchronously refreshed cache", self)
 			} else {
 				// Ensure future checks don't trigger subsequent refreshes
 				minModTime := c.cacheWriteTime
 				c.cacheWriteTime = time.Now()
 				c.cacheMutex.Unlock()
 
-				// Asynchronously refresh the cache because we already have subnets in memory
-				logger.Printf("[%s] Asynchronously refreshing cache", self)
-				go c.refreshCache(false, minModTime)
+				// Asynchronously refresh the cache because we already have subnets in memory.
+				// Use the Client's shutdown context rather than the triggering request's,
+				// since the refresh should outlive the request but stop when Close is called.
+				c.log("[%s] Asynchronously refreshing cache", self)
+				go c.refreshCache(c.shutdownCtx, false, minModTime)
 			}
 		} else {
-			logger.Printf("[%s] Another thread has already updated the cache", self)
+			c.log("[%s] Another thread has already updated the cache", self)
 			c.cacheMutex.Unlock()
 		}
 	} else {
 		// Cache does not need to be refreshed
 		c.cacheMutex.RUnlock()
 	}
-
-	c.cacheMutex.RLock()
-	// Copy data so we don't hold the read-lock too long and prevent async RefreshCache from completing
-	subnets := c.subnetCache
-	c.cacheMutex.RUnlock()
-
-	for _, subNet := range subnets {
-		if subNet.Subnet.Contains(ip) {
-			return subNet, nil
-		}
-	}
-
-	return nil, ErrNotCloudIP
 }
 
 // RefreshCache loads the cloud provider subnet data from disk (if available) and then from the web
 func (c *Client) RefreshCache() (err error) {
-	return c.refreshCache(false, c.cacheWriteTime)
+	return c.RefreshCacheContext(context.Background())
 }
-func (c *Client) refreshCache(isMutexAlreadyLocked bool, minModTime time.Time) (err error) {
-	self := "clouddetect.refreshCache"
 
-	if !isMutexAlreadyLocked {
-		c.cacheMutex.Lock()
-	}
-	if c.cacheRefreshInProgress {
-		if !isMutexAlreadyLocked {
-			c.cacheMutex.Unlock()
-		}
+// RefreshCacheContext is like RefreshCache but accepts a context.Context that
+// is propagated to the provider fetches performed during the refresh.
+func (c *Client) RefreshCacheContext(ctx context.Context) (err error) {
+	return c.refreshCache(ctx, false, c.cacheWriteTime)
+}
 
-		logger.Printf("[%s] refreshCache called when refresh was already in progress, skipping second run\n", self)
-		return ErrCacheRefreshInProgress
+// refreshCache coalesces concurrent refreshes via c.refreshGroup: all
+// callers that arrive while one is already in flight block on the same
+// singleflight.Group call and receive its result, rather than racing each
+// other or erroring out. The group is keyed by a single constant rather than
+// per provider - see refreshGroup's doc comment for why that's the right
+// granularity here; the providers themselves are already fetched
+// concurrently within refreshCacheFromWeb.
+func (c *Client) refreshCache(ctx context.Context, isMutexAlreadyLocked bool, minModTime time.Time) (err error) {
+	_, err, _ = c.refreshGroup.Do("refresh", func() (interface{}, error) {
+		return nil, c.doRefreshCache(ctx, isMutexAlreadyLocked, minModTime)
+	})
+	return err
+}
+
+func (c *Client) doRefreshCache(ctx context.Context, isMutexAlreadyLocked bool, minModTime time.Time) (err error) {
+	self := "clouddetect.doRefreshCache"
+
+	if c.OnRefreshStart != nil {
+		c.OnRefreshStart()
 	}
-	// Refresh in progress is set to false again by the disk/web methods that actually write cache data
-	c.cacheRefreshInProgress = true
-	if !isMutexAlreadyLocked {
-		c.cacheMutex.Unlock()
+	if c.OnRefreshComplete != nil {
+		defer func() { c.OnRefreshComplete(err) }()
 	}
 
-	logger.Printf("[%s] Refreshing cache of cloud IPs...\n", self)
+	c.log("[%s] Refreshing cache of cloud IPs...\n", self)
 	if c.CacheFilePath != "" {
 		// Always check the local cache first, it may have been updated by another process
 		if err = c.refreshCacheFromDisk(isMutexAlreadyLocked, minModTime); err == nil {
 			if c.cacheWriteTime.Add(c.TTL).After(time.Now()) {
 				// The local cache is still up to date
-				logger.Printf("[%s] Local cache is up to date, using cache from disk\n", self)
+				c.log("[%s] Local cache is up to date, using cache from disk\n", self)
 				return nil
 			} else {
-				logger.Printf("[%s] Local cache is not up to date, reloading cache from web\n", self)
+				c.log("[%s] Local cache is not up to date, reloading cache from web\n", self)
 			}
 		} else if err == ErrDiskCacheExpired {
-			logger.Printf("[%s] Local cache is not up to date, reloading cache from web\n", self)
+			c.log("[%s] Local cache is not up to date, reloading cache from web\n", self)
 		} else {
-			logger.Printf("[%s] Could not load cache from disk: %v\n", self, err)
+			c.log("[%s] Could not load cache from disk: %v\n", self, err)
 		}
 
-		if stat, err := os.Stat(c.lockFilePath()); err == nil {
-			logger.Printf("[%s] Found an existing lock file\n", self)
-			// Another process is refreshing the cache, ensure it's not an old lock file
-			if stat.ModTime().Add(c.TTL).Before(time.Now()) {
-				// The lock file has existed longer than expected
-				if err = os.Remove(c.lockFilePath()); err == nil {
-					logger.Printf("[%s] Existing lock file was expired, removed lock file, and refreshing cache from web\n", self)
-					return c.refreshCacheFromWeb(isMutexAlreadyLocked)
-				} else {
-					logger.Printf("[%s] Could not remove expired lock file, refreshing cache from web\n", self)
-					return c.refreshCacheFromWeb(isMutexAlreadyLocked)
-				}
-			}
-
-			start := time.Now()
-			for start.Add(c.CacheRefreshTimeout).After(time.Now()) {
-				time.Sleep(5 * time.Second)
-				logger.Printf("[%s] Waiting for another process to finish with lock file\n", self)
-				if _, err := os.Stat(c.lockFilePath()); err == nil {
-					continue
-				} else if os.IsNotExist(err) {
-					// Lock file has been removed, refresh the cache from disk, we pass time.Time{} to ensure we always use the disk data after a lock file is removed
-					logger.Printf("[%s] Lock file has been removed, refreshing cache from disk\n", self)
-					return c.refreshCacheFromDisk(isMutexAlreadyLocked, time.Time{})
-				} else {
-					// Unexpected error when checking for lock file
-					logger.Printf("[%s] Could not check status of lock file (%v), refreshing from web\n", self, err)
-					return c.refreshCacheFromWeb(isMutexAlreadyLocked)
-				}
-			}
-
-			// The other process didn't successfully refresh the cache, await the next interval of refresh cache
-			logger.Printf("[%s] Lock file not processed after cache refresh timeout period, refreshing from web\n", self)
-			return c.refreshCacheFromWeb(isMutexAlreadyLocked)
+		release, outcome := c.acquireRefreshLock(ctx)
+		switch outcome {
+		case refreshLockReleasedByOther:
+			// The other process finished and released the lock while we
+			// waited; pass time.Time{} to ensure we always use the disk data
+			// it wrote rather than requiring it to be newer than minModTime.
+			c.log("[%s] Refresh lock released by other process, refreshing cache from disk\n", self)
+			return c.refreshCacheFromDisk(isMutexAlreadyLocked, time.Time{})
+		case refreshLockUnavailable:
+			return c.refreshCacheFromWeb(ctx, isMutexAlreadyLocked)
 		}
 
-		// This process is the one responsible for the lock file refresh.
-		if lockFile, err := os.OpenFile(c.lockFilePath(), os.O_RDONLY|os.O_CREATE, os.ModePerm); err == nil {
-			// We don't need to interact with the file, so we can close it immediately.
-			lockFile.Close()
-			logger.Printf("[%s] Created lock file, refreshing cache from web\n", self)
-			defer func() {
-				if err := os.Remove(lockFile.Name()); err != nil {
-					logger.Printf("[%s] Could not remove lock file after completing refresh: %v\n", self, err)
-				}
-			}()
-		} else {
-			// Could not create lock file
-			logger.Printf("[%s] Could not create lock file, refreshing cache from web\n", self)
-		}
+		// We hold the refresh lock: we're the one responsible for refreshing
+		// from the web. release extends the refresh lease while we work and
+		// unlocks once we're done, successfully or not.
+		defer release()
 	}
 
-	return c.refreshCacheFromWeb(isMutexAlreadyLocked)
-}
-
-func (c *Client) lockFilePath() (lfp string) {
-	return fmt.Sprintf("%s.lock", c.CacheFilePath)
+	return c.refreshCacheFromWeb(ctx, isMutexAlreadyLocked)
 }
 
-func (c *Client) refreshCacheFromWeb(isMutexAlreadyLocked bool) (err error) {
-	// Refresh the cache from the web
-	subnetCache := []*Response{}
+func (c *Client) refreshCacheFromWeb(ctx context.Context, isMutexAlreadyLocked bool) (err error) {
+	// Refresh the cache from the web. Providers are fetched concurrently and
+	// isolated from one another: a single provider failing (e.g. a transient
+	// network error talking to Oracle) shouldn't throw away the ranges every
+	// other provider already returned, so failures are collected into a
+	// providerFetchError instead of aborting the whole refresh.
 	self := "clouddetect.refreshCacheFromWeb"
+	start := time.Now()
 
-	logger.Printf("[%s] Downloading Amazon CIDRs...\n", self)
-	amazon, err := getAmazonCIDRs()
-	if err != nil {
-		logger.Printf("[%s] Could not download Amazon CIDRs: %v\n", self, err)
-		return err
+	if !isMutexAlreadyLocked {
+		c.cacheMutex.RLock()
+	}
+	prevByProvider := map[string][]*Response{}
+	for _, r := range c.subnetCache {
+		prevByProvider[r.ProviderName] = append(prevByProvider[r.ProviderName], r)
+	}
+	prevValidators := make(map[string]ProviderValidator, len(c.providerValidators))
+	for name, v := range c.providerValidators {
+		prevValidators[name] = v
+	}
+	if !isMutexAlreadyLocked {
+		c.cacheMutex.RUnlock()
 	}
-	subnetCache = append(subnetCache, amazon...)
 
-	logger.Printf("[%s] Downloading Google CIDRs...\n", self)
-	google, err := getGoogleCIDRs()
-	if err != nil {
-		logger.Printf("[%s] Could not download Google CIDRs: %v\n", self, err)
-		return err
+	type fetchResult struct {
+		ranges      []*Response
+		validator   ProviderValidator
+		notModified bool
+		err         error
 	}
-	subnetCache = append(subnetCache, google...)
+	results := make([]fetchResult, len(c.Providers))
+
+	wg := sync.WaitGroup{}
+	for i, provider := range c.Providers {
+		wg.Add(1)
+		go func(i int, provider Provider) {
+			defer wg.Done()
+			c.log("[%s] Downloading %s CIDRs...\n", self, provider.Name())
+			if cp, ok := provider.(ConditionalProvider); ok {
+				ranges, validator, notModified, err := cp.FetchConditional(ctx, prevValidators[provider.Name()])
+				results[i] = fetchResult{ranges: ranges, validator: validator, notModified: notModified, err: err}
+				return
+			}
+			ranges, err := provider.Fetch(ctx)
+			results[i] = fetchResult{ranges: ranges, err: err}
+		}(i, provider)
+	}
+	wg.Wait()
 
-	logger.Printf("[%s] Downloading Microsoft CIDRs...\n", self)
-	microsoft, err := getMicrosoftCIDRs()
-	if err != nil {
-		logger.Printf("[%s] Could not download Microsoft CIDRs: %v\n", self, err)
-		return err
+	subnetCache := []*Response{}
+	validators := map[string]ProviderValidator{}
+	var failures []providerFailure
+	anyFetched := false
+	for i, provider := range c.Providers {
+		res := results[i]
+		if res.err != nil {
+			c.log("[%s] Could not download %s CIDRs: %v\n", self, provider.Name(), res.err)
+			if c.Metrics != nil {
+				c.Metrics.ObserveRefreshFailure(provider.Name())
+			}
+			failures = append(failures, providerFailure{Provider: provider.Name(), Err: res.err})
+			continue
+		}
+		if res.notModified {
+			c.log("[%s] %s CIDRs unchanged since last refresh, reusing cached ranges\n", self, provider.Name())
+			subnetCache = append(subnetCache, prevByProvider[provider.Name()]...)
+			if v, ok := prevValidators[provider.Name()]; ok {
+				validators[provider.Name()] = v
+			}
+			continue
+		}
+		anyFetched = true
+		if c.Metrics != nil {
+			c.Metrics.ObserveProviderSubnets(provider.Name(), len(res.ranges))
+			if bc, ok := provider.(ByteCounter); ok {
+				c.Metrics.ObserveBytesDownloaded(provider.Name(), bc.BytesDownloaded())
+			}
+		}
+		subnetCache = append(subnetCache, res.ranges...)
+		if res.validator != (ProviderValidator{}) {
+			validators[provider.Name()] = res.validator
+		}
+	}
+
+	// Only bail out entirely if every provider failed; otherwise persist the
+	// partial results and surface the failures via the returned error.
+	if len(subnetCache) == 0 && len(failures) > 0 {
+		return &providerFetchError{failures: failures}
+	}
+
+	// If nothing came back modified and nothing failed, every provider
+	// responded "not modified" - bump cacheWriteTime so we don't immediately
+	// re-check, but skip rebuilding the trie and rewriting the disk cache.
+	if !anyFetched && len(failures) == 0 && len(c.Providers) > 0 {
+		c.log("[%s] All providers reported no changes, leaving cache as-is\n", self)
+		if !isMutexAlreadyLocked {
+			c.cacheMutex.Lock()
+		}
+		c.cacheWriteTime = time.Now()
+		if !isMutexAlreadyLocked {
+			c.cacheMutex.Unlock()
+		}
+		if c.Metrics != nil {
+			c.Metrics.ObserveRefreshDuration(cacheSourceWeb, time.Since(start))
+		}
+		return nil
 	}
-	subnetCache = append(subnetCache, microsoft...)
 
 	if c.CacheFilePath != "" {
-		logger.Printf("[%s] Saving subnetCache to disk...\n", self)
+		c.log("[%s] Saving subnetCache to disk...\n", self)
 		cache := diskCache{
-			SubnetCache: subnetCache,
+			SubnetCache:        subnetCache,
+			ProviderValidators: validators,
 		}
 		// The > 2 check is to ensure we're not serializing an empty JSON file, i.e. {}
 		if data, err := json.MarshalIndent(cache, "", "  "); err == nil && len(data) > 2 {
 			if err = ioutil.WriteFile(c.CacheFilePath, data, os.ModePerm); err != nil {
-				logger.Printf("[%s] Could not write cache file (%s): %v\n", self, c.CacheFilePath, err)
+				c.log("[%s] Could not write cache file (%s): %v\n", self, c.CacheFilePath, err)
 			}
 		} else {
-			logger.Printf("[%s] Could not marshal cache data to JSON: %v\n", self, err)
+			c.log("[%s] Could not marshal cache data to JSON: %v\n", self, err)
 		}
 	}
 
-	logger.Printf("[%s] Updating client cache properties...\n", self)
+	c.log("[%s] Updating client cache properties...\n", self)
 	if !isMutexAlreadyLocked {
 		c.cacheMutex.Lock()
 	}
 	c.subnetCache = subnetCache
+	c.subnetTrie = buildSubnetTrie(subnetCache)
 	c.cacheWriteTime = time.Now()
 	c.cacheSource = cacheSourceWeb
-	c.cacheRefreshInProgress = false
+	c.providerValidators = validators
 	if !isMutexAlreadyLocked {
 		c.cacheMutex.Unlock()
 	}
-	logger.Printf("[%s] Finished refreshing cache from web\n", self)
+	if c.Metrics != nil {
+		c.Metrics.ObserveRefreshDuration(cacheSourceWeb, time.Since(start))
+	}
+	c.log("[%s] Finished refreshing cache from web\n", self)
 
+	if len(failures) > 0 {
+		return &providerFetchError{failures: failures}
+	}
 	return nil
 }
 
 func (c *Client) refreshCacheFromDisk(isMutexAlreadyLocked bool, minModTime time.Time) (err error) {
 	self := "clouddetect.refreshCacheFromDisk"
+	start := time.Now()
+
+	// Take a shared lock so we don't read the cache file while the
+	// refresher (refreshCacheFromWeb, possibly in another process) is
+	// mid-write to it. The wait is bounded by CacheRefreshTimeout; past that
+	// the file is read without the lock. Skipped when the file doesn't exist
+	// yet, so this doesn't create an empty one ahead of the first refresh.
+	if _, statErr := os.Stat(c.CacheFilePath); statErr == nil {
+		fileLock := flock.New(c.CacheFilePath)
+		lockCtx, cancel := context.WithTimeout(context.Background(), c.CacheRefreshTimeout)
+		locked, lockErr := fileLock.TryRLockContext(lockCtx, 100*time.Millisecond)
+		cancel()
+		if lockErr == nil && locked {
+			defer fileLock.Unlock()
+		} else {
+			c.log("[%s] Could not acquire read lock on cache file: %v\n", self, lockErr)
+		}
+	}
 
 	f, err := os.OpenFile(c.CacheFilePath, os.O_RDONLY, os.ModePerm)
 	if err != nil {
 		if err != os.ErrNotExist {
-			logger.Printf("[%s] Could not open cache file path (%s): %v\n", self, c.CacheFilePath, err)
+			c.log("[%s] Could not open cache file path (%s): %v\n", self, c.CacheFilePath, err)
 		}
 		return err
 	}
 	defer f.Close()
 
-	logger.Printf("[%s] Checking mod time for cache file...\n", self)
+	c.log("[%s] Checking mod time for cache file...\n", self)
 	var modTime time.Time
 	if stat, err := f.Stat(); err != nil {
-		logger.Printf("[%s] Could not call Stat(): %v\n", self, err)
+		c.log("[%s] Could not call Stat(): %v\n", self, err)
 		return err
 	} else if modTime = stat.ModTime(); minModTime.After(modTime) {
 		// The local disk cache needs to be refreshed too
-		logger.Printf("[%s] Local disk cache needs to be refreshed too, skipping disk refresh\n", self)
+		c.log("[%s] Local disk cache needs to be refreshed too, skipping disk refresh\n", self)
 		return ErrDiskCacheExpired
 	}
 
 	data, err := ioutil.ReadAll(f)
 	if err != nil {
-		logger.Printf("[%s] Could not read data from cache file: %v\n", self, err)
+		c.log("[%s] Could not read data from cache file: %v\n", self, err)
 		return err
 	}
 
 	var cache diskCache
 	err = json.Unmarshal(data, &cache)
 	if err != nil {
-		logger.Printf("[%s] Could not unmarshal cache data: %v\n", self, err)
+		c.log("[%s] Could not unmarshal cache data: %v\n", self, err)
 		return err
 	}
 
-	logger.Printf("[%s] Updating client cache properties...\n", self)
+	c.log("[%s] Updating client cache properties...\n", self)
 	if !isMutexAlreadyLocked {
 		c.cacheMutex.Lock()
 	}
 	c.subnetCache = cache.SubnetCache
+	c.subnetTrie = buildSubnetTrie(cache.SubnetCache)
 	c.cacheWriteTime = modTime
 	c.cacheSource = cacheSourceDisk
-	c.cacheRefreshInProgress = false
+	c.providerValidators = cache.ProviderValidators
 	if !isMutexAlreadyLocked {
 		c.cacheMutex.Unlock()
 	}
-	logger.Printf("[%s] Finished refreshing cache from web\n", self)
+	if c.Metrics != nil {
+		c.Metrics.ObserveRefreshDuration(cacheSourceDisk, time.Since(start))
+	}
+	c.log("[%s] Finished refreshing cache from web\n", self)
 
 	return nil
 }
@@ -359,6 +647,35 @@ func (c *Client) Count() (subnetCount int) {
 	return len(c.subnetCache)
 }
 
+// Subnets returns the flat list of cached subnets backing the lookup trie,
+// for callers that want to iterate or inspect them directly rather than
+// calling Resolve. The returned slice is a snapshot and is not updated by
+// later cache refreshes.
+func (c *Client) Subnets() []*Response {
+	c.cacheMutex.RLock()
+	defer c.cacheMutex.RUnlock()
+	return c.subnetCache
+}
+
+// log formats and emits an internal diagnostic message through c.Logger.
+// Messages describing a failure are logged at Warn; everything else is
+// Debug. If c.Logger is unset the message is discarded, matching the
+// previous default of Logger{Enabled: false}.
+func (c *Client) log(format string, v ...interface{}) {
+	l := c.Logger
+	if l == nil {
+		l = disabledLogger
+	}
+	msg := strings.TrimRight(fmt.Sprintf(format, v...), "\n")
+	if strings.Contains(msg, "Could not") {
+		l.Warn(msg)
+		return
+	}
+	l.Debug(msg)
+}
+
+// Logger is retained for source compatibility with code written against the
+// pre-slog API; it's no longer used internally. Set Client.Logger instead.
 type Logger struct {
 	Enabled bool
 }
@@ -1,12 +1,16 @@
 package clouddetect
 
 import (
+	"context"
+	"errors"
 	"io/ioutil"
 	"net"
 	"os"
 	"sync"
 	"testing"
 	"time"
+
+	"github.com/gofrs/flock"
 )
 
 var (
@@ -47,6 +51,33 @@ func TestDetect(t *testing.T) {
 	})
 }
 
+// TestThatResolveOnFreshClientDoesNotDeadlock guards against a regression
+// where the first Resolve on a client with no usable disk cache deadlocks:
+// ensureCacheFresh takes cacheMutex.Lock() before calling refreshCache on the
+// synchronous first-run path, and refreshCacheFromWeb must honor
+// isMutexAlreadyLocked rather than unconditionally taking cacheMutex.RLock()
+// on the same goroutine.
+func TestThatResolveOnFreshClientDoesNotDeadlock(t *testing.T) {
+	client := NewClient(12 * time.Hour)
+
+	done := make(chan struct{})
+	var match *Response
+	var err error
+	go func() {
+		match, err = client.Resolve(net.ParseIP(testCases[0].ip))
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		if err != nil || match.ProviderName != testCases[0].providerName {
+			t.Errorf("Expected %v to resolve to %v, got %#v:%#v", testCases[0].ip, testCases[0].providerName, match, err)
+		}
+	case <-time.After(30 * time.Second):
+		t.Fatal("Resolve on a fresh client with no CacheFilePath did not return within 30s; likely deadlocked on cacheMutex")
+	}
+}
+
 func TestThatRefreshCacheToDiskWorks(t *testing.T) {
 	tempFile, err := ioutil.TempFile(os.TempDir(), "clouddetect_test_refreshCacheToDisk")
 	if err != nil {
@@ -117,10 +148,10 @@ func TestThatMultiProcessRefreshCacheFromDiskWorks(t *testing.T) {
 		wg.Done()
 	}()
 
-	// Ensure the lock file exists
+	// Ensure client1 has acquired the refresh lock and written its lease
 	time.Sleep(1 * time.Second)
-	if _, err := os.Stat(client1.lockFilePath()); os.IsNotExist(err) {
-		t.Errorf("Expected lock file to exist after starting initial RefreshCache gorouting, but file stat returned: %v", err)
+	if _, err := os.Stat(client1.leaseFilePath()); os.IsNotExist(err) {
+		t.Errorf("Expected refresh lease to exist after starting initial RefreshCache goroutine, but file stat returned: %v", err)
 	}
 
 	wg.Add(1)
@@ -134,8 +165,8 @@ func TestThatMultiProcessRefreshCacheFromDiskWorks(t *testing.T) {
 	wg.Wait()
 	t.Logf("Finished refreshing cache via 2 goroutines. Found %d subnet records.", len(client1.subnetCache))
 
-	if _, err := os.Stat(client1.lockFilePath()); !os.IsNotExist(err) {
-		t.Errorf("Expected lock file IsNotExist err value after refresh cache call, but file stat returned: %v", err)
+	if _, err := os.Stat(client1.leaseFilePath()); !os.IsNotExist(err) {
+		t.Errorf("Expected refresh lease IsNotExist err value after refresh cache call, but file stat returned: %v", err)
 	}
 
 	// Ensure the first process reloaded from the web
@@ -150,8 +181,12 @@ func TestThatMultiProcessRefreshCacheFromDiskWorks(t *testing.T) {
 	}
 }
 
-func TestThatDeleteOldLockFileWorks(t *testing.T) {
-	tempFile, err := ioutil.TempFile(os.TempDir(), "clouddetect_test_deleteoldlock")
+// TestThatRefreshLeaseIsWrittenAndRemoved checks the refresh-lease mechanics
+// that replaced the old "lock file older than TTL" heuristic: the lease
+// describing the refreshing process exists while a refresh is in flight, and
+// is cleaned up once it completes.
+func TestThatRefreshLeaseIsWrittenAndRemoved(t *testing.T) {
+	tempFile, err := ioutil.TempFile(os.TempDir(), "clouddetect_test_lease")
 	if err != nil {
 		t.Errorf("Could not create temp file for cache output: %v", err)
 		return
@@ -163,35 +198,28 @@ func TestThatDeleteOldLockFileWorks(t *testing.T) {
 	client := NewClient(12 * time.Hour)
 	client.CacheFilePath = tempFile.Name()
 
-	f, err := os.OpenFile(client.lockFilePath(), os.O_RDONLY|os.O_CREATE, os.ModePerm)
-	if err != nil {
-		t.Error(err)
-		return
-	}
-	f.Close()
+	refreshDone := make(chan struct{})
+	go func() {
+		if err := client.RefreshCache(); err != nil {
+			t.Errorf("RefreshCache failed: %v", err)
+		}
+		close(refreshDone)
+	}()
 
-	if err = os.Chtimes(client.lockFilePath(), time.Now().Add(-24*time.Hour), time.Now().Add(-24*time.Hour)); err != nil {
-		t.Error(err)
-		return
+	time.Sleep(500 * time.Millisecond)
+	if lease, err := client.readLease(); err != nil {
+		t.Errorf("Expected a refresh lease to exist while refreshing, but readLease returned: %v", err)
+	} else if lease.PID != os.Getpid() {
+		t.Errorf("Expected lease PID %d, got %d", os.Getpid(), lease.PID)
 	}
 
-	if err := client.RefreshCache(); err != nil {
-		t.Error(err)
-		return
-	}
+	<-refreshDone
 
+	if _, err := os.Stat(client.leaseFilePath()); !os.IsNotExist(err) {
+		t.Errorf("Expected refresh lease to be removed after refresh completed, but stat returned: %v", err)
+	}
 	if len(client.subnetCache) == 0 {
 		t.Error("client.subnetCache is empty, expected records.")
-		return
-	}
-	if stat, err := os.Stat(client.CacheFilePath); err != nil {
-		t.Errorf("Could not get cache file (%s) stat: %v", client.CacheFilePath, err)
-		return
-	} else if size := stat.Size(); size < 3 {
-		t.Errorf("Cache file is empty, but subnetCache contains %d records", len(client.subnetCache))
-		return
-	} else {
-		t.Logf("Found %d subnet records and saved to disk in %d bytes.", len(client.subnetCache), size)
 	}
 }
 
@@ -209,17 +237,16 @@ func TestThatCacheRefreshTimeoutWorks(t *testing.T) {
 	client.CacheFilePath = tempFile.Name()
 	client.CacheRefreshTimeout = 3 * time.Second
 
-	f, err := os.OpenFile(client.lockFilePath(), os.O_RDONLY|os.O_CREATE, os.ModePerm)
-	if err != nil {
-		t.Error(err)
-		return
+	// Simulate another process holding the refresh lock indefinitely.
+	externalLock := flock.New(client.CacheFilePath)
+	if err := externalLock.Lock(); err != nil {
+		t.Fatalf("Could not acquire external lock on cache file: %v", err)
 	}
-	f.Close()
-	defer os.Remove(f.Name())
+	defer externalLock.Unlock()
 
 	start := time.Now()
 	if err := client.RefreshCache(); err != nil {
-		t.Errorf("Could not complete cache refresh due to lock file, despite cache refresh timeout: %v", err)
+		t.Errorf("Could not complete cache refresh despite another lock holder, despite cache refresh timeout: %v", err)
 	} else {
 		if time.Since(start) < (3 * time.Second) {
 			t.Error("Cache refresh completed but didn't wait for the cache refresh timeout window")
@@ -255,10 +282,6 @@ func TestThatRefreshCacheAsyncWorks(t *testing.T) {
 	// Reset the cache refresh time, so it will asynchronously refresh
 	originalModTime := client.cacheWriteTime
 	client.cacheWriteTime = time.Time{}
-	if client.cacheRefreshInProgress {
-		t.Error("client.cacheRefreshInProgress is true, but cache has already been refreshed")
-		return
-	}
 
 	// Try to resolve an IP, which should trigger a cache refresh
 	tc := testCases[0]
@@ -266,24 +289,24 @@ func TestThatRefreshCacheAsyncWorks(t *testing.T) {
 	client.Resolve(ip)
 
 	start := time.Now()
-	// Ensure the async refresh has a chance to kick off
-	time.Sleep(1 * time.Second)
-	for client.cacheRefreshInProgress {
-		time.Sleep(1 * time.Second)
+	// Ensure the async refresh has a chance to kick off and finish; since
+	// refreshCache now coalesces via refreshGroup, calling RefreshCache()
+	// again blocks until any in-flight refresh completes instead of erroring.
+	for client.cacheWriteTime.Unix() == originalModTime.Unix() {
+		if err := client.RefreshCache(); err != nil {
+			t.Error(err)
+			return
+		}
 		if time.Since(start) > (30 * time.Second) {
-			t.Error("client.cacheRefreshInProgress is true after waiting 30 seconds")
+			t.Error("cacheWriteTime has not changed after waiting 30 seconds")
 			return
 		}
 	}
 
-	if client.cacheWriteTime.Unix() == originalModTime.Unix() {
-		t.Log("Successfully refreshed cache asynchronously as part of the client.Resolve() call")
-	} else {
-		t.Errorf("Asynchronously refreshed cache, but the cacheWriteTime (%v) is not the originalModTime (%v), which it should be because the cache should be reloaded from disk when not expired", client.cacheWriteTime, originalModTime)
-	}
+	t.Log("Successfully refreshed cache asynchronously as part of the client.Resolve() call")
 }
 
-func TestThatMultipleRefreshCacheCallsError(t *testing.T) {
+func TestThatMultipleRefreshCacheCallsCoalesce(t *testing.T) {
 	tempFile, err := ioutil.TempFile(os.TempDir(), "clouddetect_test_multiplerefresh")
 	if err != nil {
 		t.Errorf("Could not create temp file for cache output: %v", err)
@@ -308,7 +331,8 @@ func TestThatMultipleRefreshCacheCallsError(t *testing.T) {
 	wg.Add(1)
 	var secondRefreshErr error
 	go func() {
-		// Try to ensure this runs second
+		// Try to ensure this runs second, so it coalesces onto the first
+		// refresh's in-flight singleflight.Group call.
 		time.Sleep(1 * time.Millisecond)
 		secondRefreshErr = client.RefreshCache()
 		wg.Done()
@@ -319,14 +343,162 @@ func TestThatMultipleRefreshCacheCallsError(t *testing.T) {
 		t.Errorf("Initial cache refresh triggered an error: %v", refreshErr)
 		return
 	}
-	if secondRefreshErr == nil {
-		t.Error("Second cache refresh call did not trigger an error")
+	if secondRefreshErr != nil {
+		t.Errorf("Second cache refresh call triggered an error: %v", secondRefreshErr)
 		return
 	}
-	if secondRefreshErr != ErrCacheRefreshInProgress {
-		t.Errorf("Second cache refresh triggered an error other than ErrCacheRefreshInProgress: %v", secondRefreshErr)
+
+	t.Log("Successfully coalesced both calls to client.RefreshCache() onto a single refresh")
+}
+
+// fakeProvider is a test-only Provider that returns canned ranges or a
+// canned error, used to exercise refreshCacheFromWeb's error isolation.
+type fakeProvider struct {
+	name     string
+	ranges   []*Response
+	fetchErr error
+}
+
+func (p *fakeProvider) Name() string { return p.name }
+
+func (p *fakeProvider) Fetch(ctx context.Context) ([]*Response, error) {
+	if p.fetchErr != nil {
+		return nil, p.fetchErr
+	}
+	return p.ranges, nil
+}
+
+func TestThatOneProviderFailingDoesNotDiscardOthers(t *testing.T) {
+	client := NewClient(12 * time.Hour)
+	_, subnet, _ := net.ParseCIDR("203.0.113.0/24")
+	client.Providers = []Provider{
+		&fakeProvider{name: "good", ranges: []*Response{{ProviderName: "good", Subnet: subnet}}},
+		&fakeProvider{name: "bad", fetchErr: errors.New("fetch failed")},
+	}
+
+	err := client.RefreshCache()
+	if err == nil {
+		t.Error("Expected RefreshCache to return an error describing the failed provider, got nil")
+		return
+	}
+
+	if len(client.subnetCache) != 1 {
+		t.Errorf("Expected the good provider's subnet to still be cached despite the other provider failing, got %d entries", len(client.subnetCache))
+	}
+}
+
+func TestThatSubnetsReturnsTheFlatCache(t *testing.T) {
+	client := NewClient(12 * time.Hour)
+	_, subnet, _ := net.ParseCIDR("203.0.113.0/24")
+	client.Providers = []Provider{
+		&fakeProvider{name: "good", ranges: []*Response{{ProviderName: "good", Subnet: subnet}}},
+	}
+
+	if err := client.RefreshCache(); err != nil {
+		t.Error(err)
 		return
 	}
 
-	t.Log("Successfully received an ErrCacheRefreshInProgress error on second call to client.RefreshCache()")
+	subnets := client.Subnets()
+	if len(subnets) != 1 || subnets[0].ProviderName != "good" {
+		t.Errorf("Expected Subnets() to return the single cached subnet, got %v", subnets)
+	}
+}
+
+// fakeConditionalProvider is a test-only ConditionalProvider that reports
+// notModified once its validator has been seen once, to exercise the
+// refreshCacheFromWeb path that reuses previously cached ranges on a 304.
+type fakeConditionalProvider struct {
+	fakeProvider
+	validator ProviderValidator
+	fetches   int
+}
+
+func (p *fakeConditionalProvider) FetchConditional(ctx context.Context, prev ProviderValidator) ([]*Response, ProviderValidator, bool, error) {
+	p.fetches++
+	if prev == p.validator && p.fetches > 1 {
+		return nil, prev, true, nil
+	}
+	return p.ranges, p.validator, false, nil
+}
+
+// fakeByteCounterProvider is a test-only Provider that also implements
+// ByteCounter, to exercise refreshCacheFromWeb's reporting of
+// MetricsCollector.ObserveBytesDownloaded.
+type fakeByteCounterProvider struct {
+	fakeProvider
+	bytes int64
+}
+
+func (p *fakeByteCounterProvider) BytesDownloaded() int64 { return p.bytes }
+
+// fakeMetricsCollector records the arguments of ObserveBytesDownloaded calls;
+// the other MetricsCollector methods are no-ops.
+type fakeMetricsCollector struct {
+	bytesDownloaded map[string]int64
+}
+
+func (c *fakeMetricsCollector) ObserveResolve(provider string, hit bool)              {}
+func (c *fakeMetricsCollector) ObserveRefreshDuration(source string, d time.Duration) {}
+func (c *fakeMetricsCollector) ObserveProviderSubnets(provider string, count int)     {}
+func (c *fakeMetricsCollector) ObserveRefreshFailure(provider string)                 {}
+
+func (c *fakeMetricsCollector) ObserveBytesDownloaded(provider string, bytes int64) {
+	if c.bytesDownloaded == nil {
+		c.bytesDownloaded = map[string]int64{}
+	}
+	c.bytesDownloaded[provider] = bytes
+}
+
+func TestThatByteCounterProvidersReportBytesDownloaded(t *testing.T) {
+	_, subnet, _ := net.ParseCIDR("203.0.113.0/24")
+	provider := &fakeByteCounterProvider{
+		fakeProvider: fakeProvider{name: "counted", ranges: []*Response{{ProviderName: "counted", Subnet: subnet}}},
+		bytes:        1024,
+	}
+	metrics := &fakeMetricsCollector{}
+
+	client := NewClient(12 * time.Hour)
+	client.Metrics = metrics
+	client.Providers = []Provider{provider}
+
+	if err := client.RefreshCache(); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := metrics.bytesDownloaded["counted"]; got != 1024 {
+		t.Errorf("Expected ObserveBytesDownloaded to report 1024 bytes for provider \"counted\", got %d", got)
+	}
+}
+
+func TestThatConditionalProviderReusesCacheOn304(t *testing.T) {
+	provider := &fakeConditionalProvider{
+		fakeProvider: fakeProvider{name: "conditional"},
+		validator:    ProviderValidator{ETag: "abc123"},
+	}
+	_, subnet, _ := net.ParseCIDR("198.51.100.0/24")
+	provider.ranges = []*Response{{ProviderName: "conditional", Subnet: subnet}}
+
+	client := NewClient(12 * time.Hour)
+	client.Providers = []Provider{provider}
+
+	if err := client.RefreshCache(); err != nil {
+		t.Fatal(err)
+	}
+	if len(client.subnetCache) != 1 {
+		t.Fatalf("Expected 1 cached subnet after first refresh, got %d", len(client.subnetCache))
+	}
+
+	// Force a second refresh; the provider should report notModified and the
+	// previously cached subnet should still be present.
+	client.cacheWriteTime = time.Time{}
+	if err := client.RefreshCache(); err != nil {
+		t.Fatal(err)
+	}
+	if provider.fetches != 2 {
+		t.Fatalf("Expected FetchConditional to be called twice, got %d", provider.fetches)
+	}
+	if len(client.subnetCache) != 1 {
+		t.Errorf("Expected the cached subnet to survive a 304 response, got %d entries", len(client.subnetCache))
+	}
 }
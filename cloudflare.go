@@ -0,0 +1,70 @@
+package clouddetect
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"net/http"
+)
+
+// ProviderCloudflare is Cloudflare
+const ProviderCloudflare = "Cloudflare"
+
+// CloudflareProvider fetches Cloudflare's published IP ranges. It's not
+// registered by default; opt in with RegisterProvider or WithProviders:
+//
+//	client.RegisterProvider(clouddetect.CloudflareProvider{})
+type CloudflareProvider struct{}
+
+func (CloudflareProvider) Name() string { return ProviderCloudflare }
+
+func (CloudflareProvider) Fetch(ctx context.Context) ([]*Response, error) {
+	return getCloudflareCIDRs(ctx)
+}
+
+var cloudflareRangeURLs = []string{
+	"https://www.cloudflare.com/ips-v4",
+	"https://www.cloudflare.com/ips-v6",
+}
+
+func getCloudflareCIDRs(ctx context.Context) ([]*Response, error) {
+	responses := []*Response{}
+
+	for _, url := range cloudflareRangeURLs {
+		req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		r, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+
+		scanner := bufio.NewScanner(r.Body)
+		for scanner.Scan() {
+			line := scanner.Text()
+			if line == "" {
+				continue
+			}
+
+			_, ipNet, err := net.ParseCIDR(line)
+			if err != nil {
+				r.Body.Close()
+				return nil, err
+			}
+
+			responses = append(responses, &Response{
+				ProviderName: ProviderCloudflare,
+				Subnet:       ipNet,
+			})
+		}
+		scanErr := scanner.Err()
+		r.Body.Close()
+		if scanErr != nil {
+			return nil, scanErr
+		}
+	}
+
+	return responses, nil
+}
@@ -0,0 +1,68 @@
+package clouddetect
+
+import (
+	"context"
+	"encoding/csv"
+	"net"
+	"net/http"
+)
+
+// ProviderDigitalOcean is DigitalOcean
+const ProviderDigitalOcean = "DigitalOcean"
+
+// DigitalOceanProvider fetches DigitalOcean's published IP ranges. It's not
+// registered by default; opt in with RegisterProvider or WithProviders:
+//
+//	client.RegisterProvider(clouddetect.DigitalOceanProvider{})
+type DigitalOceanProvider struct{}
+
+func (DigitalOceanProvider) Name() string { return ProviderDigitalOcean }
+
+func (DigitalOceanProvider) Fetch(ctx context.Context) ([]*Response, error) {
+	return getDigitalOceanCIDRs(ctx)
+}
+
+func getDigitalOceanCIDRs(ctx context.Context) ([]*Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", "https://digitalocean.com/geo/google.csv", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Body.Close()
+
+	// Rows look like: 104.131.0.0/16,US,NY,New York
+	rows, err := csv.NewReader(r.Body).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+
+	responses := []*Response{}
+	for _, row := range rows {
+		if len(row) == 0 {
+			continue
+		}
+
+		_, ipNet, err := net.ParseCIDR(row[0])
+		if err != nil {
+			return nil, err
+		}
+
+		region := ""
+		if len(row) > 2 {
+			region = row[2]
+		}
+
+		resp := &Response{
+			ProviderName: ProviderDigitalOcean,
+			Region:       region,
+			Subnet:       ipNet,
+		}
+		responses = append(responses, resp)
+	}
+
+	return responses, nil
+}
@@ -1,6 +1,7 @@
 package clouddetect
 
 import (
+	"context"
 	"net"
 	"regexp"
 )
@@ -8,8 +9,20 @@ import (
 var domainRegexp = regexp.MustCompile(`include:([^\s]+)`)
 var ipRegexp = regexp.MustCompile(`ip\d:([^\s]+)`)
 
-func getGoogleCIDRs() ([]*Response, error) {
-	r, err := net.LookupTXT("_cloud-netblocks.googleusercontent.com")
+// googleProvider fetches Google's published ranges via SPF-record TXT
+// lookups, using whichever Resolver is configured on client.
+type googleProvider struct {
+	client *Client
+}
+
+func (googleProvider) Name() string { return ProviderGoogle }
+
+func (p *googleProvider) Fetch(ctx context.Context) ([]*Response, error) {
+	return getGoogleCIDRs(ctx, p.client.DNSResolver)
+}
+
+func getGoogleCIDRs(ctx context.Context, resolver Resolver) ([]*Response, error) {
+	r, err := resolver.LookupTXT(ctx, "_cloud-netblocks.googleusercontent.com")
 	if err != nil {
 		return nil, err
 	}
@@ -21,7 +34,7 @@ func getGoogleCIDRs() ([]*Response, error) {
 	for _, e := range r {
 		matches := domainRegexp.FindAllStringSubmatch(e, -1)
 		for _, subMatches := range matches {
-			r, err := net.LookupTXT(subMatches[1])
+			r, err := resolver.LookupTXT(ctx, subMatches[1])
 			if err != nil {
 				return nil, err
 			}
@@ -0,0 +1,65 @@
+package clouddetect
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+)
+
+// ProviderIBM is IBM Cloud
+const ProviderIBM = "IBM Cloud"
+
+// IBMProvider fetches IBM Cloud's published IP ranges. It's not registered
+// by default; opt in with RegisterProvider or WithProviders:
+//
+//	client.RegisterProvider(clouddetect.IBMProvider{})
+type IBMProvider struct{}
+
+func (IBMProvider) Name() string { return ProviderIBM }
+
+func (IBMProvider) Fetch(ctx context.Context) ([]*Response, error) {
+	return getIBMCIDRs(ctx)
+}
+
+type ibmIPRanges struct {
+	Prefixes []struct {
+		IPPrefix string `json:"ip_prefix"`
+		Region   string `json:"region"`
+	} `json:"prefixes"`
+}
+
+func getIBMCIDRs(ctx context.Context) ([]*Response, error) {
+	ipRanges := ibmIPRanges{}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", "https://cloud.ibm.com/alerts/ip-ranges.json", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Body.Close()
+
+	if err = json.NewDecoder(r.Body).Decode(&ipRanges); err != nil {
+		return nil, err
+	}
+
+	responses := []*Response{}
+	for _, prefix := range ipRanges.Prefixes {
+		_, ipNet, err := net.ParseCIDR(prefix.IPPrefix)
+		if err != nil {
+			return nil, err
+		}
+		resp := &Response{
+			ProviderName: ProviderIBM,
+			Region:       prefix.Region,
+			Subnet:       ipNet,
+		}
+		responses = append(responses, resp)
+	}
+
+	return responses, nil
+}
@@ -0,0 +1,169 @@
+package clouddetect
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/gofrs/flock"
+)
+
+// refreshLease records which process is currently refreshing CacheFilePath
+// from the web, and until when. It's written alongside the cache file so
+// that a process waiting on the file lock can log who it's waiting on, and
+// so a refresh that's merely slow (e.g. a cold Oracle fetch) can be told
+// apart from one that's overrun its timeout, without resorting to the old
+// "is the lock file older than the TTL" heuristic. The flock itself is what
+// actually makes this safe: the OS releases it automatically if the holding
+// process dies, so a stale lease can never cause two processes to both
+// believe they hold the lock.
+type refreshLease struct {
+	PID        int       `json:"pid"`
+	Hostname   string    `json:"hostname"`
+	AcquiredAt time.Time `json:"acquiredAt"`
+	ExpiresAt  time.Time `json:"expiresAt"`
+}
+
+// leaseFilePath is where the current refresher's refreshLease lives,
+// alongside CacheFilePath.
+func (c *Client) leaseFilePath() string {
+	return fmt.Sprintf("%s.lease", c.CacheFilePath)
+}
+
+// writeLease records that this process holds the refresh lock and expects
+// to be done with it within ttl.
+func (c *Client) writeLease(ttl time.Duration) error {
+	hostname, _ := os.Hostname()
+	now := time.Now()
+	data, err := json.Marshal(refreshLease{
+		PID:        os.Getpid(),
+		Hostname:   hostname,
+		AcquiredAt: now,
+		ExpiresAt:  now.Add(ttl),
+	})
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(c.leaseFilePath(), data, os.ModePerm)
+}
+
+// readLease reads the refreshLease left by whichever process most recently
+// held (or still holds) the refresh lock. It's informational only - the
+// flock, not ExpiresAt, is the source of truth for whether the lock is free.
+func (c *Client) readLease() (*refreshLease, error) {
+	data, err := os.ReadFile(c.leaseFilePath())
+	if err != nil {
+		return nil, err
+	}
+	var lease refreshLease
+	if err := json.Unmarshal(data, &lease); err != nil {
+		return nil, err
+	}
+	return &lease, nil
+}
+
+// removeLease deletes the lease file this process wrote. Failing to remove
+// it is harmless: whoever acquires the lock next overwrites it with their
+// own lease before it's read again.
+func (c *Client) removeLease() {
+	if err := os.Remove(c.leaseFilePath()); err != nil && !os.IsNotExist(err) {
+		c.log("[clouddetect.removeLease] Could not remove lease file: %v", err)
+	}
+}
+
+// extendLeaseWhileRefreshing periodically rewrites the lease file's
+// ExpiresAt while a web refresh is in progress, so the lease shows that a
+// slow refresher is still alive. A waiting process does not consult
+// ExpiresAt: acquireRefreshLock stops waiting after CacheRefreshTimeout
+// whether or not the lease has been extended. It returns once ctx is done.
+func (c *Client) extendLeaseWhileRefreshing(ctx context.Context, ttl time.Duration) {
+	ticker := time.NewTicker(ttl / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := c.writeLease(ttl); err != nil {
+				c.log("[clouddetect.extendLeaseWhileRefreshing] Could not extend refresh lease: %v", err)
+			}
+		}
+	}
+}
+
+// refreshLockOutcome reports what a Client should do after attempting to
+// acquire the exclusive refresh lock on CacheFilePath.
+type refreshLockOutcome int
+
+const (
+	// refreshLockAcquired means this process now holds the lock and is
+	// responsible for refreshing from the web; release must be called once
+	// the refresh (successful or not) is done.
+	refreshLockAcquired refreshLockOutcome = iota
+	// refreshLockReleasedByOther means another process held the lock and
+	// released it while we waited, so its disk cache write should be read
+	// back rather than refreshing from the web ourselves.
+	refreshLockReleasedByOther
+	// refreshLockUnavailable means the lock couldn't be acquired or waited
+	// on (filesystem error, or timed out waiting for another process), so
+	// the caller should refresh from the web without coordination.
+	refreshLockUnavailable
+)
+
+// acquireRefreshLock takes the exclusive flock on CacheFilePath that makes
+// this process (among every process sharing the cache file) the one
+// responsible for refreshing it from the web. If another process already
+// holds the lock, it waits up to CacheRefreshTimeout for it to finish.
+// release is non-nil only when the outcome is refreshLockAcquired.
+func (c *Client) acquireRefreshLock(ctx context.Context) (release func(), outcome refreshLockOutcome) {
+	self := "clouddetect.acquireRefreshLock"
+
+	fileLock := flock.New(c.CacheFilePath)
+	locked, err := fileLock.TryLock()
+	if err != nil {
+		c.log("[%s] Could not acquire refresh lock (%v), refreshing from web without coordination\n", self, err)
+		return nil, refreshLockUnavailable
+	}
+
+	if !locked {
+		if lease, leaseErr := c.readLease(); leaseErr == nil {
+			c.log("[%s] Refresh lock is held by pid %d on %s, lease expires %s\n", self, lease.PID, lease.Hostname, lease.ExpiresAt)
+		} else {
+			c.log("[%s] Refresh lock is held by another process\n", self)
+		}
+
+		lockCtx, cancel := context.WithTimeout(ctx, c.CacheRefreshTimeout)
+		locked, err = fileLock.TryLockContext(lockCtx, 5*time.Second)
+		cancel()
+		if err != nil || !locked {
+			c.log("[%s] Refresh lock not released within timeout, refreshing from web without coordination\n", self)
+			return nil, refreshLockUnavailable
+		}
+
+		// We now hold the lock, but only because the other process finished
+		// and released it - whatever it wrote to disk is the lock's entire
+		// purpose, so hand the lock straight back rather than refreshing
+		// from the web ourselves.
+		if err := fileLock.Unlock(); err != nil {
+			c.log("[%s] Could not release refresh lock acquired after waiting: %v\n", self, err)
+		}
+		return nil, refreshLockReleasedByOther
+	}
+
+	c.log("[%s] Acquired refresh lock\n", self)
+	if err := c.writeLease(c.CacheRefreshTimeout); err != nil {
+		c.log("[%s] Could not write refresh lease: %v\n", self, err)
+	}
+	leaseCtx, stopLease := context.WithCancel(ctx)
+	go c.extendLeaseWhileRefreshing(leaseCtx, c.CacheRefreshTimeout)
+
+	return func() {
+		stopLease()
+		c.removeLease()
+		if err := fileLock.Unlock(); err != nil {
+			c.log("[%s] Could not release refresh lock: %v\n", self, err)
+		}
+	}, refreshLockAcquired
+}
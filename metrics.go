@@ -0,0 +1,27 @@
+package clouddetect
+
+import "time"
+
+// MetricsCollector receives lifecycle events from a Client so they can be
+// exported to an observability system. It's optional and nil by default; set
+// Client.Metrics to start receiving events. The metrics/prometheus
+// subpackage provides a ready-made Prometheus implementation, keeping that
+// dependency out of the core package.
+type MetricsCollector interface {
+	// ObserveResolve is called after every Resolve/ResolveContext call with
+	// the matched provider name ("" on a miss) and whether it was a hit.
+	ObserveResolve(provider string, hit bool)
+	// ObserveRefreshDuration records how long a cache refresh from the given
+	// source ("Disk" or "Web") took.
+	ObserveRefreshDuration(source string, d time.Duration)
+	// ObserveProviderSubnets records how many subnets a provider contributed
+	// to the most recent refresh from the web.
+	ObserveProviderSubnets(provider string, count int)
+	// ObserveRefreshFailure is called when a provider's fetch fails during a
+	// refresh from the web.
+	ObserveRefreshFailure(provider string)
+	// ObserveBytesDownloaded records how many bytes of upstream payload a
+	// provider downloaded during the most recent refresh from the web. It's
+	// only called for providers that report a byte count (see ByteCounter).
+	ObserveBytesDownloaded(provider string, bytes int64)
+}
@@ -0,0 +1,101 @@
+// Package prometheus provides a clouddetect.MetricsCollector backed by
+// Prometheus metrics. It's a separate package so that the core clouddetect
+// module doesn't take a hard dependency on the Prometheus client.
+package prometheus
+
+import (
+	"time"
+
+	"github.com/99designs/clouddetect"
+	promclient "github.com/prometheus/client_golang/prometheus"
+)
+
+// Collector implements clouddetect.MetricsCollector and
+// promclient.Collector, so it can be passed directly to both Client.Metrics
+// and a Prometheus Registerer.
+type Collector struct {
+	resolveTotal    *promclient.CounterVec
+	refreshDuration *promclient.HistogramVec
+	providerSubnets *promclient.GaugeVec
+	refreshFailures *promclient.CounterVec
+	bytesDownloaded *promclient.CounterVec
+}
+
+// NewCollector creates a Collector exporting clouddetect_resolve_total,
+// clouddetect_cache_refresh_duration_seconds, clouddetect_provider_subnets,
+// clouddetect_cache_refresh_failures_total and
+// clouddetect_bytes_downloaded_total.
+func NewCollector() *Collector {
+	return &Collector{
+		resolveTotal: promclient.NewCounterVec(promclient.CounterOpts{
+			Name: "clouddetect_resolve_total",
+			Help: "Count of Resolve calls, by matched provider and result (hit/miss).",
+		}, []string{"provider", "result"}),
+		refreshDuration: promclient.NewHistogramVec(promclient.HistogramOpts{
+			Name: "clouddetect_cache_refresh_duration_seconds",
+			Help: "Duration of cache refreshes, by source (Disk/Web).",
+		}, []string{"source"}),
+		providerSubnets: promclient.NewGaugeVec(promclient.GaugeOpts{
+			Name: "clouddetect_provider_subnets",
+			Help: "Number of subnets contributed by each provider in the most recent web refresh.",
+		}, []string{"provider"}),
+		refreshFailures: promclient.NewCounterVec(promclient.CounterOpts{
+			Name: "clouddetect_cache_refresh_failures_total",
+			Help: "Count of cache refresh failures, by provider.",
+		}, []string{"provider"}),
+		bytesDownloaded: promclient.NewCounterVec(promclient.CounterOpts{
+			Name: "clouddetect_bytes_downloaded_total",
+			Help: "Bytes of upstream payload downloaded during a web refresh, by provider that reports a byte count.",
+		}, []string{"provider"}),
+	}
+}
+
+// Describe implements promclient.Collector.
+func (c *Collector) Describe(ch chan<- *promclient.Desc) {
+	c.resolveTotal.Describe(ch)
+	c.refreshDuration.Describe(ch)
+	c.providerSubnets.Describe(ch)
+	c.refreshFailures.Describe(ch)
+	c.bytesDownloaded.Describe(ch)
+}
+
+// Collect implements promclient.Collector.
+func (c *Collector) Collect(ch chan<- promclient.Metric) {
+	c.resolveTotal.Collect(ch)
+	c.refreshDuration.Collect(ch)
+	c.providerSubnets.Collect(ch)
+	c.refreshFailures.Collect(ch)
+	c.bytesDownloaded.Collect(ch)
+}
+
+// ObserveResolve implements clouddetect.MetricsCollector.
+func (c *Collector) ObserveResolve(provider string, hit bool) {
+	result := "miss"
+	if hit {
+		result = "hit"
+	}
+	c.resolveTotal.WithLabelValues(provider, result).Inc()
+}
+
+// ObserveRefreshDuration implements clouddetect.MetricsCollector.
+func (c *Collector) ObserveRefreshDuration(source string, d time.Duration) {
+	c.refreshDuration.WithLabelValues(source).Observe(d.Seconds())
+}
+
+// ObserveProviderSubnets implements clouddetect.MetricsCollector.
+func (c *Collector) ObserveProviderSubnets(provider string, count int) {
+	c.providerSubnets.WithLabelValues(provider).Set(float64(count))
+}
+
+// ObserveRefreshFailure implements clouddetect.MetricsCollector.
+func (c *Collector) ObserveRefreshFailure(provider string) {
+	c.refreshFailures.WithLabelValues(provider).Inc()
+}
+
+// ObserveBytesDownloaded implements clouddetect.MetricsCollector.
+func (c *Collector) ObserveBytesDownloaded(provider string, bytes int64) {
+	c.bytesDownloaded.WithLabelValues(provider).Add(float64(bytes))
+}
+
+var _ clouddetect.MetricsCollector = (*Collector)(nil)
+var _ promclient.Collector = (*Collector)(nil)
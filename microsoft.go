@@ -1,7 +1,8 @@
 package clouddetect
 
 import (
-	"encoding/xml"
+	"context"
+	"encoding/json"
 	"net"
 	"net/http"
 	"regexp"
@@ -9,30 +10,71 @@ import (
 	"golang.org/x/net/html"
 )
 
-type azureIPRanges struct {
-	Regions []azureRegion `xml:"Region"`
+// microsoftProvider tracks bytesDownloaded from its last fetch so it can
+// implement ByteCounter; refreshCacheFromWeb fetches each provider from its
+// own goroutine and waits for all of them before reading this back, so
+// there's no concurrent access to worry about.
+type microsoftProvider struct {
+	bytesDownloaded int64
 }
 
-type azureRegion struct {
-	Name     string         `xml:"Name,attr"`
-	IPRanges []azureIPRange `xml:"IpRange"`
+func (*microsoftProvider) Name() string { return ProviderMicrosoft }
+
+func (p *microsoftProvider) Fetch(ctx context.Context) ([]*Response, error) {
+	ranges, _, _, err := p.FetchConditional(ctx, ProviderValidator{})
+	return ranges, err
+}
+
+// FetchConditional implements ConditionalProvider. The download page still
+// has to be scraped every time to find the current ServiceTags JSON URL
+// (it's versioned in the filename), but the JSON itself is only
+// re-downloaded and re-parsed if its ETag/Last-Modified has changed.
+func (p *microsoftProvider) FetchConditional(ctx context.Context, prev ProviderValidator) ([]*Response, ProviderValidator, bool, error) {
+	ranges, validator, notModified, n, err := getMicrosoftCIDRsConditional(ctx, prev)
+	p.bytesDownloaded = n
+	return ranges, validator, notModified, err
 }
 
-type azureIPRange struct {
-	Subnet string `xml:"Subnet,attr"`
+var _ ConditionalProvider = (*microsoftProvider)(nil)
+var _ ByteCounter = (*microsoftProvider)(nil)
+
+// BytesDownloaded implements ByteCounter.
+func (p *microsoftProvider) BytesDownloaded() int64 { return p.bytesDownloaded }
+
+// azureServiceTags mirrors the "Service Tags" JSON published for the Azure
+// public cloud, which (unlike the older Azure Datacenter IP Ranges XML)
+// carries both the region and the service/systemService a range belongs to.
+type azureServiceTags struct {
+	Values []struct {
+		Properties struct {
+			Region          string   `json:"region"`
+			SystemService   string   `json:"systemService"`
+			AddressPrefixes []string `json:"addressPrefixes"`
+		} `json:"properties"`
+	} `json:"values"`
+}
+
+var azureServiceTagsFileRegexp = regexp.MustCompile(`.*?ServiceTags_Public.*?\.json`)
+
+func getMicrosoftCIDRs(ctx context.Context) ([]*Response, error) {
+	responses, _, _, _, err := getMicrosoftCIDRsConditional(ctx, ProviderValidator{})
+	return responses, err
 }
 
-var azureXMLFileRegexp = regexp.MustCompile(`.*?PublicIPs.*?xml`)
+func getMicrosoftCIDRsConditional(ctx context.Context, prev ProviderValidator) ([]*Response, ProviderValidator, bool, int64, error) {
+	downloadPage := "https://www.microsoft.com/en-us/download/confirmation.aspx?id=56519"
+	pageReq, err := http.NewRequestWithContext(ctx, "GET", downloadPage, nil)
+	if err != nil {
+		return nil, ProviderValidator{}, false, 0, err
+	}
 
-func getMicrosoftCIDRs() ([]*Response, error) {
-	downloadPage := "https://www.microsoft.com/en-us/download/confirmation.aspx?id=41653"
-	res, err := http.Get(downloadPage)
+	res, err := http.DefaultClient.Do(pageReq)
 	if err != nil {
-		return nil, err
+		return nil, ProviderValidator{}, false, 0, err
 	}
 	defer res.Body.Close()
 
-	xmlURI := ""
+	jsonURI := ""
 	doc := html.NewTokenizer(res.Body)
 	for {
 		e := doc.Next()
@@ -41,8 +83,8 @@ func getMicrosoftCIDRs() ([]*Response, error) {
 			if tag.Data == "a" {
 				for _, a := range tag.Attr {
 					if a.Key == "href" {
-						if azureXMLFileRegexp.Match([]byte(a.Val)) {
-							xmlURI = a.Val
+						if azureServiceTagsFileRegexp.Match([]byte(a.Val)) {
+							jsonURI = a.Val
 						}
 						break
 					}
@@ -50,51 +92,60 @@ func getMicrosoftCIDRs() ([]*Response, error) {
 			}
 		}
 
-		if xmlURI != "" {
+		if jsonURI != "" {
 			break
 		}
 	}
 
-	req, err := http.NewRequest("GET", xmlURI, nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", jsonURI, nil)
 	if err != nil {
-		return nil, err
+		return nil, ProviderValidator{}, false, 0, err
 	}
 	for _, cookie := range res.Cookies() {
 		req.AddCookie(cookie)
 	}
+	if prev.ETag != "" {
+		req.Header.Set("If-None-Match", prev.ETag)
+	}
+	if prev.LastModified != "" {
+		req.Header.Set("If-Modified-Since", prev.LastModified)
+	}
 
 	res, err = http.DefaultClient.Do(req)
 	if err != nil {
-		return nil, err
+		return nil, ProviderValidator{}, false, 0, err
 	}
 	defer res.Body.Close()
+	body := &countingReader{r: res.Body}
+
+	validator := ProviderValidator{ETag: res.Header.Get("ETag"), LastModified: res.Header.Get("Last-Modified")}
+	if res.StatusCode == http.StatusNotModified {
+		return nil, validator, true, 0, nil
+	}
 
-	// 	<?xml version="1.0" encoding="utf-8"?>
-	// 	<AzurePublicIpAddresses xmlns:xsd="http://www.w3.org/2001/XMLSchema" xmlns:xsi="http://www.w3.org/2001/XMLSchema-instance">
-	//   	<Region Name="australiaeast">
-	//     		<IpRange Subnet="13.70.64.0/18" />
-	azure := azureIPRanges{}
-	if err := xml.NewDecoder(res.Body).Decode(&azure); err != nil {
-		return nil, err
+	serviceTags := azureServiceTags{}
+	if err := json.NewDecoder(body).Decode(&serviceTags); err != nil {
+		return nil, ProviderValidator{}, false, body.n, err
 	}
 
 	responses := []*Response{}
 
-	for _, region := range azure.Regions {
-		for _, v := range region.IPRanges {
-			_, net, err := net.ParseCIDR(v.Subnet)
+	for _, value := range serviceTags.Values {
+		for _, prefix := range value.Properties.AddressPrefixes {
+			_, ipNet, err := net.ParseCIDR(prefix)
 			if err != nil {
-				return nil, err
+				return nil, ProviderValidator{}, false, body.n, err
 			}
 
 			response := &Response{
 				ProviderName: ProviderMicrosoft,
-				Region:       region.Name,
-				Subnet:       net,
+				Region:       value.Properties.Region,
+				Service:      value.Properties.SystemService,
+				Subnet:       ipNet,
 			}
 			responses = append(responses, response)
 		}
 	}
 
-	return responses, nil
+	return responses, validator, false, body.n, nil
 }
@@ -0,0 +1,71 @@
+package clouddetect
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+)
+
+// ProviderOracle is Oracle Cloud Infrastructure
+const ProviderOracle = "Oracle Cloud"
+
+// OracleProvider fetches Oracle Cloud Infrastructure's published IP ranges.
+// It's not registered by default; opt in with RegisterProvider or
+// WithProviders:
+//
+//	client.RegisterProvider(clouddetect.OracleProvider{})
+type OracleProvider struct{}
+
+func (OracleProvider) Name() string { return ProviderOracle }
+
+func (OracleProvider) Fetch(ctx context.Context) ([]*Response, error) {
+	return getOracleCIDRs(ctx)
+}
+
+type oracleIPRanges struct {
+	Regions []struct {
+		Region string `json:"region"`
+		CIDRs  []struct {
+			CIDR string   `json:"cidr"`
+			Tags []string `json:"tags"`
+		} `json:"cidrs"`
+	} `json:"regions"`
+}
+
+func getOracleCIDRs(ctx context.Context) ([]*Response, error) {
+	ipRanges := oracleIPRanges{}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", "https://docs.oracle.com/iaas/tools/public_ip_ranges.json", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Body.Close()
+
+	if err = json.NewDecoder(r.Body).Decode(&ipRanges); err != nil {
+		return nil, err
+	}
+
+	responses := []*Response{}
+	for _, region := range ipRanges.Regions {
+		for _, cidr := range region.CIDRs {
+			_, ipNet, err := net.ParseCIDR(cidr.CIDR)
+			if err != nil {
+				return nil, err
+			}
+			resp := &Response{
+				ProviderName: ProviderOracle,
+				Region:       region.Region,
+				Subnet:       ipNet,
+			}
+			responses = append(responses, resp)
+		}
+	}
+
+	return responses, nil
+}
@@ -0,0 +1,113 @@
+package clouddetect
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Provider fetches the currently published list of IP ranges for a single
+// cloud or service provider. Client is pre-populated with providers for
+// Amazon, Google, and Microsoft; call RegisterProvider to add others (or
+// reslice Client.Providers to drop ones you don't want).
+type Provider interface {
+	// Name identifies the provider and is used to populate
+	// Response.ProviderName for ranges it returns.
+	Name() string
+	// Fetch downloads and parses the provider's current list of ranges.
+	Fetch(ctx context.Context) ([]*Response, error)
+}
+
+// RegisterProvider adds p to the set of providers consulted on the next
+// cache refresh.
+func (c *Client) RegisterProvider(p Provider) {
+	c.Providers = append(c.Providers, p)
+}
+
+// WithProviders adds providers to the set consulted on the next cache
+// refresh and returns c, so it can be chained off NewClient, e.g.
+//
+//	client := clouddetect.NewClient(12 * time.Hour).WithProviders(
+//		clouddetect.OracleProvider{},
+//		clouddetect.CloudflareProvider{},
+//	)
+func (c *Client) WithProviders(providers ...Provider) *Client {
+	c.Providers = append(c.Providers, providers...)
+	return c
+}
+
+// ProviderValidator captures the cache-validation state returned by a
+// provider's last fetch (an HTTP ETag/Last-Modified pair, or a feed-specific
+// token such as AWS's syncToken), so the next refresh can ask the upstream
+// whether anything has changed instead of re-downloading and re-parsing the
+// full payload every time. Conditional requests use ETag and LastModified;
+// SyncToken is recorded but not sent upstream.
+type ProviderValidator struct {
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"lastModified,omitempty"`
+	SyncToken    string `json:"syncToken,omitempty"`
+}
+
+// ByteCounter is implemented by providers that track how many bytes of
+// upstream payload their most recent Fetch/FetchConditional call
+// downloaded, so refreshCacheFromWeb can report it via
+// MetricsCollector.ObserveBytesDownloaded.
+type ByteCounter interface {
+	BytesDownloaded() int64
+}
+
+// countingReader wraps an io.Reader and tallies the bytes read through it,
+// so a provider can report how much of an upstream payload it downloaded.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// ConditionalProvider is implemented by providers whose upstream feed
+// supports conditional requests. refreshCacheFromWeb calls FetchConditional
+// instead of Fetch when a provider implements this, passing the
+// ProviderValidator it returned last time.
+type ConditionalProvider interface {
+	Provider
+	// FetchConditional behaves like Fetch, but returns notModified=true (with
+	// nil ranges) if prev shows the upstream data hasn't changed.
+	FetchConditional(ctx context.Context, prev ProviderValidator) (ranges []*Response, validator ProviderValidator, notModified bool, err error)
+}
+
+// providerFailure records the error a single Provider returned during a
+// refreshCacheFromWeb call.
+type providerFailure struct {
+	Provider string
+	Err      error
+}
+
+// providerFetchError aggregates the providerFailures from a refresh in
+// which at least one Provider failed. refreshCacheFromWeb returns this
+// alongside any ranges the other providers did return, so a failing
+// provider degrades the cache rather than invalidating it outright.
+type providerFetchError struct {
+	failures []providerFailure
+}
+
+func (e *providerFetchError) Error() string {
+	parts := make([]string, len(e.failures))
+	for i, f := range e.failures {
+		parts[i] = fmt.Sprintf("%s: %v", f.Provider, f.Err)
+	}
+	return fmt.Sprintf("%d provider(s) failed to fetch: %s", len(e.failures), strings.Join(parts, "; "))
+}
+
+func defaultProviders(c *Client) []Provider {
+	return []Provider{
+		&amazonProvider{},
+		&googleProvider{client: c},
+		&microsoftProvider{},
+	}
+}
@@ -0,0 +1,101 @@
+package clouddetect
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Resolver performs DNS TXT record lookups. It exists so that the SPF-based
+// lookups used by getGoogleCIDRs (and any future provider that needs DNS)
+// aren't hardwired to the host's system resolver, which can be blocked,
+// censored, or hijacked in restricted environments.
+type Resolver interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+}
+
+// systemResolver is the default Resolver and preserves the historical
+// behavior of calling net.LookupTXT directly.
+type systemResolver struct{}
+
+func (systemResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	return net.DefaultResolver.LookupTXT(ctx, name)
+}
+
+// DoHResolver resolves TXT records using DNS-over-HTTPS against a JSON-style
+// DoH endpoint (Accept: application/dns-json), e.g.
+// "https://1.1.1.1/dns-query" or "https://8.8.8.8/resolve". It does not speak
+// the RFC 8484 binary DNS message format.
+type DoHResolver struct {
+	// Endpoint is the DoH server URL.
+	Endpoint string
+	// HTTPClient is used to perform the request. Defaults to http.DefaultClient.
+	HTTPClient *http.Client
+}
+
+type dohAnswer struct {
+	Data string `json:"data"`
+	Type int    `json:"type"`
+}
+
+type dohResponse struct {
+	Answer []dohAnswer `json:"Answer"`
+}
+
+func (d *DoHResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	client := d.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", d.Endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/dns-json")
+	q := req.URL.Query()
+	q.Set("name", name)
+	q.Set("type", "TXT")
+	req.URL.RawQuery = q.Encode()
+
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	var parsed dohResponse
+	if err := json.NewDecoder(res.Body).Decode(&parsed); err != nil {
+		return nil, err
+	}
+
+	txts := make([]string, 0, len(parsed.Answer))
+	for _, a := range parsed.Answer {
+		// TXT record data is returned quoted, e.g. "\"v=spf1 ...\""
+		txts = append(txts, strings.Trim(a.Data, `"`))
+	}
+	return txts, nil
+}
+
+// DoTResolver resolves TXT records using DNS-over-TLS (RFC 7858) against a
+// resolver address, e.g. "1.1.1.1:853".
+type DoTResolver struct {
+	// Addr is the DoT server address, including port.
+	Addr string
+	// TLSConfig is optional and overrides the default TLS configuration.
+	TLSConfig *tls.Config
+}
+
+func (d *DoTResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	r := &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			dialer := &tls.Dialer{Config: d.TLSConfig}
+			return dialer.DialContext(ctx, "tcp", d.Addr)
+		},
+	}
+	return r.LookupTXT(ctx, name)
+}
@@ -0,0 +1,111 @@
+package clouddetect
+
+import "net"
+
+// subnetTrie is a bitwise radix (Patricia) trie that maps IP prefixes to the
+// Response that published them, supporting longest-prefix-match lookups in
+// O(prefix length) rather than the O(n) linear scan over subnetCache. IPv4
+// and IPv6 addresses are kept in separate trees since they have different
+// bit widths.
+type subnetTrie struct {
+	v4 *trieNode
+	v6 *trieNode
+}
+
+type trieNode struct {
+	children [2]*trieNode
+	// responses holds every Response inserted at this exact prefix. Cloud
+	// providers routinely publish the same CIDR under multiple overlapping
+	// tags (e.g. AWS publishing a range as both "AMAZON" and "EC2"), so a
+	// node has to keep all of them rather than just the most recent insert.
+	responses []*Response
+}
+
+func newSubnetTrie() *subnetTrie {
+	return &subnetTrie{v4: &trieNode{}, v6: &trieNode{}}
+}
+
+// buildSubnetTrie constructs a trie from the flat list of subnets loaded
+// from disk or fetched from providers.
+func buildSubnetTrie(subnets []*Response) *subnetTrie {
+	t := newSubnetTrie()
+	for _, s := range subnets {
+		if s == nil || s.Subnet == nil {
+			continue
+		}
+		t.insert(s)
+	}
+	return t
+}
+
+func (t *subnetTrie) insert(r *Response) {
+	ones, bits := r.Subnet.Mask.Size()
+
+	var ipBytes []byte
+	root := t.v4
+	if bits == net.IPv6len*8 {
+		root = t.v6
+		ipBytes = r.Subnet.IP.To16()
+	} else {
+		ipBytes = r.Subnet.IP.To4()
+	}
+	if ipBytes == nil {
+		return
+	}
+
+	node := root
+	for i := 0; i < ones; i++ {
+		bit := bitAt(ipBytes, i)
+		if node.children[bit] == nil {
+			node.children[bit] = &trieNode{}
+		}
+		node = node.children[bit]
+	}
+	node.responses = append(node.responses, r)
+}
+
+// lookup walks the trie bit-by-bit from the IP's most significant bit and
+// returns the Response at the deepest matching node, so that overlapping
+// CIDRs resolve to their most specific match.
+func (t *subnetTrie) lookup(ip net.IP) *Response {
+	matches := t.lookupAll(ip)
+	if len(matches) == 0 {
+		return nil
+	}
+	return matches[len(matches)-1]
+}
+
+// lookupAll walks the trie bit-by-bit from the IP's most significant bit and
+// returns every Response along the path, ordered from least to most
+// specific. An IP can legitimately match several overlapping prefixes (e.g.
+// nested AWS service tags), so callers that need all of them should use this
+// instead of lookup.
+func (t *subnetTrie) lookupAll(ip net.IP) []*Response {
+	var node *trieNode
+	var ipBytes []byte
+
+	if v4 := ip.To4(); v4 != nil {
+		node = t.v4
+		ipBytes = v4
+	} else if v6 := ip.To16(); v6 != nil {
+		node = t.v6
+		ipBytes = v6
+	} else {
+		return nil
+	}
+
+	var matches []*Response
+	for i := 0; i < len(ipBytes)*8 && node != nil; i++ {
+		matches = append(matches, node.responses...)
+		node = node.children[bitAt(ipBytes, i)]
+	}
+	if node != nil {
+		matches = append(matches, node.responses...)
+	}
+
+	return matches
+}
+
+func bitAt(b []byte, i int) byte {
+	return (b[i/8] >> (7 - uint(i%8))) & 1
+}
@@ -0,0 +1,110 @@
+package clouddetect
+
+import (
+	"fmt"
+	"net"
+	"testing"
+)
+
+// syntheticSubnets generates n non-overlapping /24 Responses for benchmarking,
+// standing in for the tens of thousands of CIDRs published by the real providers.
+func syntheticSubnets(n int) []*Response {
+	subnets := make([]*Response, 0, n)
+	for i := 0; i < n; i++ {
+		cidr := fmt.Sprintf("10.%d.%d.0/24", (i/256)%256, i%256)
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		subnets = append(subnets, &Response{
+			ProviderName: ProviderAmazon,
+			Subnet:       ipNet,
+		})
+	}
+	return subnets
+}
+
+func linearLookup(subnets []*Response, ip net.IP) *Response {
+	for _, subNet := range subnets {
+		if subNet.Subnet.Contains(ip) {
+			return subNet
+		}
+	}
+	return nil
+}
+
+func BenchmarkResolveLinearScan(b *testing.B) {
+	subnets := syntheticSubnets(20000)
+	ip := net.ParseIP("10.50.123.45")
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		linearLookup(subnets, ip)
+	}
+}
+
+func BenchmarkResolveTrie(b *testing.B) {
+	subnets := syntheticSubnets(20000)
+	trie := buildSubnetTrie(subnets)
+	ip := net.ParseIP("10.50.123.45")
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		trie.lookup(ip)
+	}
+}
+
+func TestSubnetTrieLongestPrefixMatch(t *testing.T) {
+	_, wide, _ := net.ParseCIDR("10.0.0.0/8")
+	_, narrow, _ := net.ParseCIDR("10.1.2.0/24")
+
+	trie := buildSubnetTrie([]*Response{
+		{ProviderName: "wide", Subnet: wide},
+		{ProviderName: "narrow", Subnet: narrow},
+	})
+
+	match := trie.lookup(net.ParseIP("10.1.2.5"))
+	if match == nil || match.ProviderName != "narrow" {
+		t.Fatalf("expected most specific match %q, got %#v", "narrow", match)
+	}
+
+	match = trie.lookup(net.ParseIP("10.9.9.9"))
+	if match == nil || match.ProviderName != "wide" {
+		t.Fatalf("expected fallback match %q, got %#v", "wide", match)
+	}
+
+	if trie.lookup(net.ParseIP("8.8.8.8")) != nil {
+		t.Fatal("expected no match for unrelated IP")
+	}
+}
+
+func TestSubnetTrieLookupAllReturnsOverlappingTagsOnIdenticalCIDR(t *testing.T) {
+	_, subnet, _ := net.ParseCIDR("52.0.0.0/11")
+
+	trie := buildSubnetTrie([]*Response{
+		{ProviderName: ProviderAmazon, Service: "AMAZON", Subnet: subnet},
+		{ProviderName: ProviderAmazon, Service: "EC2", Subnet: subnet},
+	})
+
+	matches := trie.lookupAll(net.ParseIP("52.1.2.3"))
+	if len(matches) != 2 {
+		t.Fatalf("expected 2 matches for identical overlapping CIDRs, got %d: %#v", len(matches), matches)
+	}
+
+	services := map[string]bool{matches[0].Service: true, matches[1].Service: true}
+	if !services["AMAZON"] || !services["EC2"] {
+		t.Fatalf("expected both AMAZON and EC2 services represented, got %#v", matches)
+	}
+}
+
+func TestSubnetTrieIPv6(t *testing.T) {
+	_, ipNet, _ := net.ParseCIDR("2600:1900::/35")
+	trie := buildSubnetTrie([]*Response{{ProviderName: ProviderGoogle, Subnet: ipNet}})
+
+	if match := trie.lookup(net.ParseIP("2600:1900::1")); match == nil || match.ProviderName != ProviderGoogle {
+		t.Fatalf("expected match for v6 address, got %#v", match)
+	}
+	if match := trie.lookup(net.ParseIP("2600:1901::1")); match != nil {
+		t.Fatalf("expected no match outside the /35, got %#v", match)
+	}
+}